@@ -0,0 +1,100 @@
+// Package budget bounds how long a single gatherer function may run and how
+// many bytes of records it may produce. A gatherer that loops over a
+// potentially large list (pods, events, ...) can consult a Budget before each
+// record.Record it adds and bail out once either limit is hit, instead of
+// serializing an unbounded number of resources and blowing through the
+// operator's overall collection deadline.
+package budget
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// DefaultTimeout is the per-function deadline applied when a Config
+	// leaves Timeout unset.
+	DefaultTimeout = 30 * time.Second
+	// DefaultMaxBytes is the byte budget applied when a Config leaves
+	// MaxBytes unset.
+	DefaultMaxBytes = 8 * 1024 * 1024
+)
+
+// Config configures a Budget. The zero value is valid and resolves to
+// DefaultTimeout/DefaultMaxBytes; gatherers should take this from the
+// operator's Config so an administrator can tune it per-cluster.
+type Config struct {
+	Timeout  time.Duration
+	MaxBytes int64
+}
+
+// Budget wraps a context with a deadline and tracks bytes charged against it
+// so a gatherer can stop early once either runs out.
+type Budget struct {
+	ctx      context.Context
+	maxBytes int64
+	used     int64
+	skipped  []string
+}
+
+// New derives a deadline-bound context from ctx and a Budget to track bytes
+// against cfg. The returned cancel func must be called (typically via defer)
+// once the gatherer using it returns, to release the context's timer.
+func New(ctx context.Context, cfg Config) (*Budget, context.CancelFunc) {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	maxBytes := cfg.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytes
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return &Budget{ctx: ctx, maxBytes: maxBytes}, cancel
+}
+
+// Context returns the deadline-bound context a gatherer should pass to its
+// client calls.
+func (b *Budget) Context() context.Context {
+	return b.ctx
+}
+
+// Allow reports whether name may still be recorded: the context must not
+// have expired and the byte budget must not be exhausted. When it returns
+// false, Allow itself records name as skipped so the archive can explain the
+// gap; the caller should stop adding more records from whatever it's iterating.
+func (b *Budget) Allow(name string) bool {
+	select {
+	case <-b.ctx.Done():
+		b.skipped = append(b.skipped, name)
+		return false
+	default:
+	}
+
+	if b.used >= b.maxBytes {
+		b.skipped = append(b.skipped, name)
+		return false
+	}
+
+	return true
+}
+
+// Charge adds n bytes to the running total consulted by Allow.
+func (b *Budget) Charge(n int64) {
+	b.used += n
+}
+
+// Skipped returns the names passed to Allow calls that returned false, plus
+// any names added via SkipRemaining, in the order they occurred.
+func (b *Budget) Skipped() []string {
+	return b.skipped
+}
+
+// SkipRemaining records names as skipped without consulting the budget -
+// for the rest of a list a caller stopped walking early after Allow returned
+// false for one of its elements, so the archive's truncation marker names
+// every item that was never collected, not just the one that tripped it.
+func (b *Budget) SkipRemaining(names []string) {
+	b.skipped = append(b.skipped, names...)
+}
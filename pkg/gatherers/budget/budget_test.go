@@ -0,0 +1,51 @@
+package budget
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowStopsOnceBudgetExhausted(t *testing.T) {
+	b, cancel := New(context.Background(), Config{MaxBytes: 10})
+	defer cancel()
+
+	assert.True(t, b.Allow("a"))
+	b.Charge(6)
+	assert.True(t, b.Allow("b"))
+	b.Charge(6)
+
+	assert.False(t, b.Allow("c"))
+	assert.Equal(t, []string{"c"}, b.Skipped())
+}
+
+func TestAllowStopsOnceContextExpires(t *testing.T) {
+	b, cancel := New(context.Background(), Config{Timeout: time.Millisecond})
+	defer cancel()
+
+	time.Sleep(5 * time.Millisecond)
+
+	assert.False(t, b.Allow("late"))
+	assert.Equal(t, []string{"late"}, b.Skipped())
+}
+
+func TestSkipRemainingAppendsWithoutConsultingBudget(t *testing.T) {
+	b, cancel := New(context.Background(), Config{MaxBytes: 10})
+	defer cancel()
+
+	b.Charge(10)
+	assert.False(t, b.Allow("tripped"))
+	b.SkipRemaining([]string{"never-tried-1", "never-tried-2"})
+
+	assert.Equal(t, []string{"tripped", "never-tried-1", "never-tried-2"}, b.Skipped())
+}
+
+func TestNewAppliesDefaults(t *testing.T) {
+	b, cancel := New(context.Background(), Config{})
+	defer cancel()
+
+	assert.True(t, b.Allow("x"))
+	assert.Equal(t, int64(DefaultMaxBytes), b.maxBytes)
+}
@@ -0,0 +1,453 @@
+// Package deepgather implements an on-demand, must-gather-style collection of
+// the resources around a troubled workload. A gatherer that notices something
+// is wrong (an unhealthy pod, a degraded operator) can hand a Spec describing
+// "what's nearby" to a Collector and get back archive records for it, instead
+// of requiring a human to run `oc adm must-gather` after the fact.
+//
+// Collection is capped by a Budget so a single bad namespace can't blow the
+// calling gatherer's time or size limits: any object whose marshalled size
+// exceeds MaxResourceBytes is dropped rather than written, a container log is
+// cut off at MaxResourceBytes (or at whatever is left of MaxTotalBytes), and collection
+// stops as soon as MaxTotalBytes has been written, at which point the
+// remaining, un-collected resources are listed in a "skipped" record so the
+// archive stays self-describing.
+//
+// Deployment and ReplicaSet pod templates have their sensitive environment
+// variables scrubbed before being recorded, and ConfigMap data is redacted
+// outright, since this collector is meant to be reusable for namespaces
+// (etcd, kube-apiserver, ...) that routinely carry secrets in both.
+package deepgather
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	appsv1client "k8s.io/client-go/kubernetes/typed/apps/v1"
+	coordinationv1client "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	rbacv1client "k8s.io/client-go/kubernetes/typed/rbac/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/insights-operator/pkg/record"
+	"github.com/openshift/insights-operator/pkg/utils/anonymize"
+	"github.com/openshift/insights-operator/pkg/utils/marshal"
+)
+
+const (
+	// DefaultMaxResourceBytes caps how much of a single resource (an object
+	// dump or one container log) is kept.
+	DefaultMaxResourceBytes = 512 * 1024
+	// DefaultMaxTotalBytes caps how much a single Collect call may add to the
+	// archive across every resource it gathers.
+	DefaultMaxTotalBytes = 8 * 1024 * 1024
+	// DefaultLogTailLines is used for a ContainerLogSpec that doesn't set
+	// TailLines explicitly.
+	DefaultLogTailLines = int64(2000)
+	// redactedConfigMapValue replaces a deep-gathered ConfigMap's data values -
+	// keys are kept so the archive still shows what was there.
+	redactedConfigMapValue = "--- REDACTED ---"
+)
+
+// ContainerLogSpec identifies one container log to collect.
+type ContainerLogSpec struct {
+	Pod       string
+	Container string
+	Previous  bool
+	TailLines int64
+}
+
+// Spec describes the resources a gatherer wants deep-gathered, namespaced by
+// a single owning namespace (the "related resources" are expected to live
+// alongside the workload that triggered the collection).
+type Spec struct {
+	// Namespace the resources below live in.
+	Namespace string
+	// Reason is recorded alongside the collection so the archive explains
+	// why it exists (e.g. "unhealthy pod cluster-version-operator-xyz").
+	Reason string
+	// Deployments, ReplicaSets, ConfigMaps and Leases are resource names to
+	// fetch individually.
+	Deployments  []string
+	ReplicaSets  []string
+	ConfigMaps   []string
+	Leases       []string
+	// ServiceAccount, if set, is gathered together with any RoleBindings (and
+	// the Roles/ClusterRoles they reference) in Namespace that name it as a
+	// subject.
+	ServiceAccount string
+	// Containers lists the container logs to fetch.
+	Containers []ContainerLogSpec
+}
+
+// Budget bounds how much a single Collect call may write.
+type Budget struct {
+	MaxResourceBytes int64
+	MaxTotalBytes    int64
+}
+
+// DefaultBudget returns the budget gatherers should use absent a more
+// specific configuration.
+func DefaultBudget() Budget {
+	return Budget{
+		MaxResourceBytes: DefaultMaxResourceBytes,
+		MaxTotalBytes:    DefaultMaxTotalBytes,
+	}
+}
+
+// Collector walks the resources named by a Spec and turns them into archive
+// records under config/deep/<namespace>/...
+type Collector struct {
+	CoreClient  corev1client.CoreV1Interface
+	AppsClient  appsv1client.AppsV1Interface
+	RBACClient  rbacv1client.RbacV1Interface
+	CoordClient coordinationv1client.CoordinationV1Interface
+	Budget      Budget
+}
+
+// New builds a Collector with the default Budget.
+func New(
+	coreClient corev1client.CoreV1Interface,
+	appsClient appsv1client.AppsV1Interface,
+	rbacClient rbacv1client.RbacV1Interface,
+	coordClient coordinationv1client.CoordinationV1Interface,
+) *Collector {
+	return &Collector{
+		CoreClient:  coreClient,
+		AppsClient:  appsClient,
+		RBACClient:  rbacClient,
+		CoordClient: coordClient,
+		Budget:      DefaultBudget(),
+	}
+}
+
+// budgetTracker enforces Budget across a single Collect call.
+type budgetTracker struct {
+	budget  Budget
+	used    int64
+	skipped []string
+}
+
+func (t *budgetTracker) allow(name string) bool {
+	if t.used >= t.budget.MaxTotalBytes {
+		t.skip(name)
+		return false
+	}
+	return true
+}
+
+func (t *budgetTracker) charge(size int64) {
+	t.used += size
+}
+
+// remainingResourceBytes caps the per-resource limit by however much of the
+// total budget is left, so a single large log can't on its own overshoot
+// MaxTotalBytes before the next resource even gets a chance to be charged
+// against it.
+func (t *budgetTracker) remainingResourceBytes() int64 {
+	remaining := t.budget.MaxTotalBytes - t.used
+	if remaining < 0 {
+		remaining = 0
+	}
+	if t.budget.MaxResourceBytes > 0 && t.budget.MaxResourceBytes < remaining {
+		return t.budget.MaxResourceBytes
+	}
+	return remaining
+}
+
+func (t *budgetTracker) skip(name string) {
+	t.skipped = append(t.skipped, name)
+}
+
+// Collect gathers every resource named by spec, stopping early once the
+// Budget's total byte cap is reached. A missing or unreadable resource is
+// logged at V(2) and left out; the returned error slice is always nil.
+func (c *Collector) Collect(ctx context.Context, spec Spec) ([]record.Record, []error) {
+	base := fmt.Sprintf("config/deep/%s", spec.Namespace)
+	tracker := &budgetTracker{budget: c.Budget}
+	var records []record.Record
+
+	for _, name := range spec.Deployments {
+		if !tracker.allow(name) {
+			continue
+		}
+		deployment, err := c.AppsClient.Deployments(spec.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			klog.V(2).Infof("deepgather: unable to get deployment %s/%s: %v", spec.Namespace, name, err)
+			continue
+		}
+		anonymizePodTemplate(&deployment.Spec.Template)
+		if rec, ok := c.record(tracker, fmt.Sprintf("%s/deployments/%s", base, name), deployment); ok {
+			records = append(records, rec)
+		}
+	}
+
+	for _, name := range spec.ReplicaSets {
+		if !tracker.allow(name) {
+			continue
+		}
+		rs, err := c.AppsClient.ReplicaSets(spec.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			klog.V(2).Infof("deepgather: unable to get replicaset %s/%s: %v", spec.Namespace, name, err)
+			continue
+		}
+		anonymizePodTemplate(&rs.Spec.Template)
+		if rec, ok := c.record(tracker, fmt.Sprintf("%s/replicasets/%s", base, name), rs); ok {
+			records = append(records, rec)
+		}
+	}
+
+	for _, name := range spec.ConfigMaps {
+		if !tracker.allow(name) {
+			continue
+		}
+		cm, err := c.CoreClient.ConfigMaps(spec.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			klog.V(2).Infof("deepgather: unable to get configmap %s/%s: %v", spec.Namespace, name, err)
+			continue
+		}
+		redactConfigMapData(cm)
+		if rec, ok := c.record(tracker, fmt.Sprintf("%s/configmaps/%s", base, name), cm); ok {
+			records = append(records, rec)
+		}
+	}
+
+	for _, name := range spec.Leases {
+		if !tracker.allow(name) {
+			continue
+		}
+		lease, err := c.CoordClient.Leases(spec.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			klog.V(2).Infof("deepgather: unable to get lease %s/%s: %v", spec.Namespace, name, err)
+			continue
+		}
+		if rec, ok := c.record(tracker, fmt.Sprintf("%s/leases/%s", base, name), lease); ok {
+			records = append(records, rec)
+		}
+	}
+
+	if spec.ServiceAccount != "" {
+		records = append(records, c.collectServiceAccountRBAC(ctx, tracker, base, spec.Namespace, spec.ServiceAccount)...)
+	}
+
+	for _, containerLog := range spec.Containers {
+		if rec, ok := c.collectContainerLog(ctx, tracker, base, spec.Namespace, containerLog); ok {
+			records = append(records, rec)
+		}
+	}
+
+	if len(tracker.skipped) > 0 {
+		klog.V(2).Infof("deepgather: budget exceeded for %s, skipped %d resources", spec.Namespace, len(tracker.skipped))
+		records = append(records, record.Record{
+			Name: fmt.Sprintf("%s/_truncated", base),
+			Item: record.JSONMarshaller{Item: map[string]interface{}{
+				"reason":  spec.Reason,
+				"skipped": tracker.skipped,
+			}},
+		})
+	}
+
+	return records, nil
+}
+
+// record turns resource into an archive record, charging its actual
+// marshalled size against tracker. A resource whose marshalled size exceeds
+// the per-resource cap is dropped (not truncated, since truncating a
+// structured object would leave invalid JSON) and recorded as skipped.
+func (c *Collector) record(tracker *budgetTracker, name string, resource runtime.Object) (record.Record, bool) {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		klog.V(2).Infof("deepgather: unable to marshal %s: %v", name, err)
+		tracker.skip(name)
+		return record.Record{}, false
+	}
+
+	size := int64(len(data))
+	if tracker.budget.MaxResourceBytes > 0 && size > tracker.budget.MaxResourceBytes {
+		klog.V(2).Infof("deepgather: %s is %d bytes, over the %d byte per-resource cap, dropping",
+			name, size, tracker.budget.MaxResourceBytes)
+		tracker.skip(name)
+		return record.Record{}, false
+	}
+
+	tracker.charge(size)
+	return record.Record{Name: name, Item: record.ResourceMarshaller{Resource: resource}}, true
+}
+
+// anonymizePodTemplate scrubs the sensitive environment variables a
+// Deployment or ReplicaSet's pod template carries, the same way the
+// pod-listing loop in gather_cluster_version.go scrubs every live pod it
+// records. A deep-gathered template is just as likely to embed secrets in
+// Env - more so, since this collector is meant to be reused for namespaces
+// like etcd and kube-apiserver where that's the norm.
+func anonymizePodTemplate(template *corev1.PodTemplateSpec) {
+	anonymize.SensitiveEnvVars(template.Spec.InitContainers)
+	anonymize.SensitiveEnvVars(template.Spec.Containers)
+}
+
+// redactConfigMapData replaces a deep-gathered ConfigMap's Data/BinaryData
+// values with a fixed placeholder, keeping only the keys. Unlike a Deployment
+// or ReplicaSet, a ConfigMap has no fixed shape for us to pick sensitive
+// fields out of, so - since this collector can be pointed at namespaces that
+// routinely keep sensitive material in ConfigMap data - the whole value is
+// redacted rather than guessed at.
+func redactConfigMapData(cm *corev1.ConfigMap) {
+	for key := range cm.Data {
+		cm.Data[key] = redactedConfigMapValue
+	}
+	for key := range cm.BinaryData {
+		cm.BinaryData[key] = []byte(redactedConfigMapValue)
+	}
+}
+
+// collectServiceAccountRBAC gathers the ServiceAccount itself, every
+// RoleBinding in namespace and ClusterRoleBinding cluster-wide that names it
+// as a subject, and the Role/ClusterRole each of those bindings grants -
+// since a RoleBinding may itself reference a ClusterRole, and a
+// ServiceAccount is just as often bound cluster-wide (e.g. to cluster-admin)
+// as it is namespaced.
+func (c *Collector) collectServiceAccountRBAC(
+	ctx context.Context, tracker *budgetTracker, base, namespace, name string,
+) []record.Record {
+	var records []record.Record
+
+	if !tracker.allow(name) {
+		return records
+	}
+	sa, err := c.CoreClient.ServiceAccounts(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		klog.V(2).Infof("deepgather: unable to get serviceaccount %s/%s: %v", namespace, name, err)
+		return records
+	}
+	if rec, ok := c.record(tracker, fmt.Sprintf("%s/rbac/serviceaccounts/%s", base, name), sa); ok {
+		records = append(records, rec)
+	}
+
+	bindings, err := c.RBACClient.RoleBindings(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.V(2).Infof("deepgather: unable to list rolebindings in %s: %v", namespace, err)
+	}
+	for i := range bindings.Items {
+		binding := &bindings.Items[i]
+		if !bindingReferencesServiceAccount(binding.Subjects, namespace, name) {
+			continue
+		}
+		if rec, ok := c.record(tracker, fmt.Sprintf("%s/rbac/rolebindings/%s", base, binding.Name), binding); ok {
+			records = append(records, rec)
+		}
+		records = append(records, c.collectRoleRef(ctx, tracker, base, namespace, binding.RoleRef)...)
+	}
+
+	clusterBindings, err := c.RBACClient.ClusterRoleBindings().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.V(2).Infof("deepgather: unable to list clusterrolebindings: %v", err)
+		return records
+	}
+	for i := range clusterBindings.Items {
+		binding := &clusterBindings.Items[i]
+		if !bindingReferencesServiceAccount(binding.Subjects, namespace, name) {
+			continue
+		}
+		if rec, ok := c.record(tracker, fmt.Sprintf("%s/rbac/clusterrolebindings/%s", base, binding.Name), binding); ok {
+			records = append(records, rec)
+		}
+		records = append(records, c.collectClusterRole(ctx, tracker, base, binding.RoleRef.Name)...)
+	}
+
+	return records
+}
+
+// collectRoleRef fetches the Role or ClusterRole a (Cluster)RoleBinding
+// refers to.
+func (c *Collector) collectRoleRef(
+	ctx context.Context, tracker *budgetTracker, base, namespace string, roleRef rbacv1.RoleRef,
+) []record.Record {
+	switch roleRef.Kind {
+	case "Role":
+		if !tracker.allow(roleRef.Name) {
+			return nil
+		}
+		role, err := c.RBACClient.Roles(namespace).Get(ctx, roleRef.Name, metav1.GetOptions{})
+		if err != nil {
+			klog.V(2).Infof("deepgather: unable to get role %s/%s: %v", namespace, roleRef.Name, err)
+			return nil
+		}
+		if rec, ok := c.record(tracker, fmt.Sprintf("%s/rbac/roles/%s", base, role.Name), role); ok {
+			return []record.Record{rec}
+		}
+		return nil
+	case "ClusterRole":
+		return c.collectClusterRole(ctx, tracker, base, roleRef.Name)
+	default:
+		return nil
+	}
+}
+
+func (c *Collector) collectClusterRole(ctx context.Context, tracker *budgetTracker, base, name string) []record.Record {
+	if !tracker.allow(name) {
+		return nil
+	}
+	clusterRole, err := c.RBACClient.ClusterRoles().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		klog.V(2).Infof("deepgather: unable to get clusterrole %s: %v", name, err)
+		return nil
+	}
+	if rec, ok := c.record(tracker, fmt.Sprintf("%s/rbac/clusterroles/%s", base, clusterRole.Name), clusterRole); ok {
+		return []record.Record{rec}
+	}
+	return nil
+}
+
+func bindingReferencesServiceAccount(subjects []rbacv1.Subject, namespace, name string) bool {
+	for _, subject := range subjects {
+		if subject.Kind == "ServiceAccount" && subject.Name == name && subject.Namespace == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Collector) collectContainerLog(
+	ctx context.Context, tracker *budgetTracker, base, namespace string, spec ContainerLogSpec,
+) (record.Record, bool) {
+	key := fmt.Sprintf("%s/%s", spec.Pod, spec.Container)
+	if !tracker.allow(key) {
+		return record.Record{}, false
+	}
+
+	tailLines := spec.TailLines
+	if tailLines <= 0 {
+		tailLines = DefaultLogTailLines
+	}
+
+	stream, err := c.CoreClient.Pods(namespace).GetLogs(spec.Pod, &corev1.PodLogOptions{
+		Container: spec.Container,
+		Previous:  spec.Previous,
+		TailLines: &tailLines,
+	}).Stream(ctx)
+	if err != nil {
+		klog.V(2).Infof("deepgather: unable to get logs for %s/%s (previous=%t): %v", namespace, spec.Pod, spec.Previous, err)
+		return record.Record{}, false
+	}
+	defer stream.Close()
+
+	limit := tracker.remainingResourceBytes()
+	data, err := io.ReadAll(io.LimitReader(stream, limit))
+	if err != nil {
+		klog.V(2).Infof("deepgather: unable to read logs for %s/%s: %v", namespace, spec.Pod, err)
+		return record.Record{}, false
+	}
+	tracker.charge(int64(len(data)))
+
+	suffix := ""
+	if spec.Previous {
+		suffix = "-previous"
+	}
+	name := fmt.Sprintf("%s/logs/%s/%s%s.log", base, spec.Pod, spec.Container, suffix)
+	return record.Record{Name: name, Item: marshal.Raw{Str: string(data)}}, true
+}
@@ -2,7 +2,10 @@ package clusterconfig
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"regexp"
+	"strings"
 	"time"
 
 	configv1 "github.com/openshift/api/config/v1"
@@ -14,12 +17,41 @@ import (
 	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/klog/v2"
 
+	"github.com/openshift/insights-operator/pkg/gatherers/budget"
+	"github.com/openshift/insights-operator/pkg/gatherers/clusterconfig/deepgather"
 	"github.com/openshift/insights-operator/pkg/record"
 	"github.com/openshift/insights-operator/pkg/utils/anonymize"
 	"github.com/openshift/insights-operator/pkg/utils/check"
 	"github.com/openshift/insights-operator/pkg/utils/marshal"
 )
 
+// clusterVersionOperatorLease is the Lease the CVO's leader-election uses in
+// its own namespace; it's cheap to fetch and tells us whether the CVO itself
+// thought it was healthy at the time things went wrong.
+const clusterVersionOperatorLease = "cluster-version-operator-lock"
+
+const (
+	// signaturesManagedNamespace holds the ConfigMaps the cluster itself
+	// populates with signatures for verified release payloads, always named
+	// with the signaturesConfigMapPrefix.
+	signaturesManagedNamespace = "openshift-config-managed"
+	// signaturesUserNamespace may additionally hold administrator-provided
+	// signature ConfigMaps, e.g. for disconnected mirrors. Administrators
+	// don't follow the managed naming convention, so ConfigMaps here are
+	// identified by their data shape (signatureDataKey) instead of a prefix.
+	signaturesUserNamespace = "openshift-config"
+	// signaturesConfigMapPrefix is the naming convention the cluster itself
+	// uses for signature ConfigMaps in signaturesManagedNamespace.
+	signaturesConfigMapPrefix = "signatures-managed"
+	// verificationConfigMapAnnotation names the ConfigMap the release
+	// verifier consulted for its keyrings.
+	verificationConfigMapAnnotation = "release.openshift.io/verification-config-map"
+)
+
+// signatureDataKey matches the `sha256-<digest>-<n>` keys a signature
+// ConfigMap stores one or more signatures for a release digest under.
+var signatureDataKey = regexp.MustCompile(`^(sha256-[0-9a-f]{64})-\d+$`)
+
 // GatherClusterVersion Collects the `ClusterVersion` (including the cluster ID) with the name
 // 'version' and its resources.
 //
@@ -40,6 +72,11 @@ import (
 // | >= 4.2.0  | config/id													|
 // | >= 4.8.2  | config/pod/openshift-cluster-version/version.json			|
 // | >= 4.8.2  | events/openshift-cluster-version.json						|
+// | >= 4.18.0 | config/version/history.json								|
+// | >= 4.18.0 | config/version/conditional_updates.json					|
+// | >= 4.19.0 | config/deep/openshift-cluster-version/...					|
+// | >= 4.20.0 | config/version/signatures.json								|
+// | >= 4.21.0 | config/version/_truncated.json (only if budget exceeded)	|
 //
 // ### Config ID
 // `clusterconfig/version`
@@ -51,7 +88,17 @@ import (
 // None
 //
 // ### Changes
-// None
+// - 4.18.0: Added `config/version/history.json` and `config/version/conditional_updates.json`
+// to expose update-retrieval failures and risk-annotated conditional updates to Insights rules.
+// - 4.19.0: When unhealthy pods are found, also deep-gather the cluster-version operator's
+// deployment, replicaset, leader-election lease, RBAC and container logs under
+// `config/deep/openshift-cluster-version/` (see `deepgather.Collector`).
+// - 4.20.0: Added `config/version/signatures.json`, summarizing the release digests with a
+// recorded signature, the keyrings consulted, and whether verification was bypassed with `--force`.
+// - 4.21.0: The pod-listing loop now consults a `budget.Budget` before each record so it can
+// no longer run past the gatherer's time/size budget; when it stops early the skipped pods
+// are listed in `config/version/_truncated.json`. The budget is configured from the operator's
+// own Config (`g.podBudget`), defaulting to `budget.DefaultTimeout`/`budget.DefaultMaxBytes`.
 func (g *Gatherer) GatherClusterVersion(ctx context.Context) ([]record.Record, []error) {
 	gatherConfigClient, err := configv1client.NewForConfig(g.gatherKubeConfig)
 	if err != nil {
@@ -63,13 +110,23 @@ func (g *Gatherer) GatherClusterVersion(ctx context.Context) ([]record.Record, [
 		return nil, []error{err}
 	}
 
-	return getClusterVersion(ctx, gatherConfigClient, gatherKubeClient.CoreV1(), g.interval)
+	deepCollector := deepgather.New(
+		gatherKubeClient.CoreV1(), gatherKubeClient.AppsV1(), gatherKubeClient.RbacV1(), gatherKubeClient.CoordinationV1(),
+	)
+
+	// g.podBudget is populated from the operator's own Config, so an
+	// administrator can tune the pod-listing time/size bounds below the same
+	// way they tune everything else; its zero value still resolves to
+	// budget.DefaultTimeout/budget.DefaultMaxBytes.
+	return getClusterVersion(ctx, gatherConfigClient, gatherKubeClient.CoreV1(), deepCollector, g.interval, g.podBudget)
 }
 
 func getClusterVersion(ctx context.Context,
 	configClient configv1client.ConfigV1Interface,
 	coreClient corev1client.CoreV1Interface,
-	interval time.Duration) ([]record.Record, []error) {
+	deepCollector *deepgather.Collector,
+	interval time.Duration,
+	podBudgetConfig budget.Config) ([]record.Record, []error) {
 	config, err := configClient.ClusterVersions().Get(ctx, "version", metav1.GetOptions{})
 	if errors.IsNotFound(err) {
 		return nil, nil
@@ -80,6 +137,14 @@ func getClusterVersion(ctx context.Context,
 
 	records := []record.Record{
 		{Name: "config/version", Item: record.ResourceMarshaller{Resource: anonymizeClusterVersion(config)}},
+		{Name: "config/version/history", Item: record.JSONMarshaller{Item: clusterVersionHistory(config)}},
+		{Name: "config/version/conditional_updates", Item: record.JSONMarshaller{Item: clusterVersionConditionalUpdates(config)}},
+	}
+
+	if sigRecord, err := gatherClusterVersionSignatures(ctx, coreClient, config); err != nil {
+		klog.V(2).Infof("Unable to gather release signature verification state: %v", err)
+	} else {
+		records = append(records, sigRecord)
 	}
 
 	if config.Spec.ClusterID != "" {
@@ -90,19 +155,31 @@ func getClusterVersion(ctx context.Context,
 	now := time.Now()
 	var unhealthyPods []*corev1.Pod
 
-	pods, err := coreClient.Pods(namespace).List(ctx, metav1.ListOptions{})
+	podBudget, cancel := budget.New(ctx, podBudgetConfig)
+	defer cancel()
+
+	pods, err := coreClient.Pods(namespace).List(podBudget.Context(), metav1.ListOptions{})
 	if err != nil {
 		klog.V(2).Infof("Unable to find pods in namespace %s for cluster-version operator", namespace)
 		return records, nil
 	}
 	for i := range pods.Items {
 		pod := &pods.Items[i]
+		podName := fmt.Sprintf("config/pod/%s/%s", pod.Namespace, pod.Name)
+		if !podBudget.Allow(podName) {
+			klog.V(2).Infof("Gatherer budget exhausted, stopping pod collection in %s", namespace)
+			podBudget.SkipRemaining(remainingPodNames(pods.Items[i+1:]))
+			break
+		}
 		anonymize.SensitiveEnvVars(pod.Spec.Containers)
 
 		records = append(records, record.Record{
-			Name: fmt.Sprintf("config/pod/%s/%s", pod.Namespace, pod.Name),
+			Name: podName,
 			Item: record.ResourceMarshaller{Resource: pod},
 		})
+		if data, err := json.Marshal(pod); err == nil {
+			podBudget.Charge(int64(len(data)))
+		}
 
 		if check.IsHealthyPod(pod, now) {
 			continue
@@ -111,6 +188,16 @@ func getClusterVersion(ctx context.Context,
 		unhealthyPods = append(unhealthyPods, pod)
 	}
 
+	if skipped := podBudget.Skipped(); len(skipped) > 0 {
+		records = append(records, record.Record{
+			Name: "config/version/_truncated",
+			Item: record.JSONMarshaller{Item: map[string]interface{}{
+				"reason":  "gatherer time or size budget exceeded while listing pods",
+				"skipped": skipped,
+			}},
+		})
+	}
+
 	// Exit early if no unhealthy pods found
 	if len(unhealthyPods) == 0 {
 		return records, nil
@@ -123,10 +210,254 @@ func getClusterVersion(ctx context.Context,
 	}
 	records = append(records, namespaceRecords...)
 
+	if deepCollector != nil {
+		deepRecords, errs := deepCollector.Collect(ctx, deepGatherSpec(namespace, unhealthyPods))
+		if len(errs) > 0 {
+			klog.V(2).Infof("Unable to deep-gather %q: %v", namespace, errs)
+		}
+		records = append(records, deepRecords...)
+	}
+
 	return records, nil
 }
 
+// remainingPodNames renders the archive record name each of pods would have
+// been given, for reporting in a truncation marker.
+func remainingPodNames(pods []corev1.Pod) []string {
+	names := make([]string, 0, len(pods))
+	for i := range pods {
+		names = append(names, fmt.Sprintf("config/pod/%s/%s", pods[i].Namespace, pods[i].Name))
+	}
+	return names
+}
+
+// deepGatherSpec builds the deepgather.Spec for the cluster-version operator's
+// own namespace from the pods found unhealthy, so the archive captures the
+// deployment, its replicaset, the leader-election lease, the operator's RBAC,
+// and the unhealthy containers' logs the first time a problem is seen.
+func deepGatherSpec(namespace string, unhealthyPods []*corev1.Pod) deepgather.Spec {
+	spec := deepgather.Spec{
+		Namespace:      namespace,
+		Reason:         fmt.Sprintf("%d unhealthy pod(s) in %s", len(unhealthyPods), namespace),
+		Deployments:    []string{"cluster-version-operator"},
+		Leases:         []string{clusterVersionOperatorLease},
+		ServiceAccount: "cluster-version-operator",
+	}
+
+	replicaSets := map[string]struct{}{}
+	for _, pod := range unhealthyPods {
+		for _, owner := range pod.OwnerReferences {
+			if owner.Kind == "ReplicaSet" {
+				replicaSets[owner.Name] = struct{}{}
+			}
+		}
+		for _, container := range pod.Spec.Containers {
+			spec.Containers = append(spec.Containers,
+				deepgather.ContainerLogSpec{Pod: pod.Name, Container: container.Name},
+				deepgather.ContainerLogSpec{Pod: pod.Name, Container: container.Name, Previous: true},
+			)
+		}
+	}
+	for name := range replicaSets {
+		spec.ReplicaSets = append(spec.ReplicaSets, name)
+	}
+
+	return spec
+}
+
 func anonymizeClusterVersion(version *configv1.ClusterVersion) *configv1.ClusterVersion {
 	version.Spec.Upstream = configv1.URL(anonymize.URL(string(version.Spec.Upstream)))
 	return version
 }
+
+// clusterVersionHistoryEntry is a compact, per-entry projection of a
+// configv1.UpdateHistory record. It keeps the fields an Insights rule needs to
+// tell a completed update from a stalled or partially-applied one, while
+// preserving Verified/AcceptedRisks verbatim since they affect how much a rule
+// should trust the entry.
+type clusterVersionHistoryEntry struct {
+	Version        string               `json:"version"`
+	Image          string               `json:"image"`
+	State          configv1.UpdateState `json:"state"`
+	StartedTime    metav1.Time          `json:"startedTime"`
+	CompletionTime *metav1.Time         `json:"completionTime,omitempty"`
+	Verified       bool                 `json:"verified"`
+	AcceptedRisks  string               `json:"acceptedRisks,omitempty"`
+}
+
+func clusterVersionHistory(config *configv1.ClusterVersion) []clusterVersionHistoryEntry {
+	history := make([]clusterVersionHistoryEntry, 0, len(config.Status.History))
+	for _, h := range config.Status.History {
+		history = append(history, clusterVersionHistoryEntry{
+			Version:        h.Version,
+			Image:          h.Image,
+			State:          h.State,
+			StartedTime:    h.StartedTime,
+			CompletionTime: h.CompletionTime,
+			Verified:       h.Verified,
+			AcceptedRisks:  h.AcceptedRisks,
+		})
+	}
+	return history
+}
+
+// clusterVersionConditionalUpdatesRecord groups the updates the cluster-version
+// operator considers available with the risk-annotated conditional ones, and
+// the conditions that say whether the CVO was able to retrieve either set at
+// all. Force is surfaced alongside them because it changes how much weight a
+// rule should give AcceptedRisks in the history entries above.
+type clusterVersionConditionalUpdatesRecord struct {
+	AvailableUpdates   []configv1.Release                       `json:"availableUpdates,omitempty"`
+	ConditionalUpdates []configv1.ConditionalUpdate              `json:"conditionalUpdates,omitempty"`
+	Upgradeable        *configv1.ClusterOperatorStatusCondition `json:"upgradeable,omitempty"`
+	RetrievedUpdates   *configv1.ClusterOperatorStatusCondition `json:"retrievedUpdates,omitempty"`
+	Force              bool                                     `json:"force"`
+}
+
+func clusterVersionConditionalUpdates(config *configv1.ClusterVersion) clusterVersionConditionalUpdatesRecord {
+	var force bool
+	if config.Spec.DesiredUpdate != nil {
+		force = config.Spec.DesiredUpdate.Force
+	}
+
+	return clusterVersionConditionalUpdatesRecord{
+		AvailableUpdates:   anonymizeReleases(config.Status.AvailableUpdates),
+		ConditionalUpdates: anonymizeConditionalUpdates(config.Status.ConditionalUpdates),
+		Upgradeable:        findClusterVersionCondition(config, configv1.OperatorUpgradeable),
+		RetrievedUpdates:   findClusterVersionCondition(config, configv1.RetrievedUpdates),
+		Force:              force,
+	}
+}
+
+func findClusterVersionCondition(
+	config *configv1.ClusterVersion, condType configv1.ClusterStatusConditionType,
+) *configv1.ClusterOperatorStatusCondition {
+	for i := range config.Status.Conditions {
+		if config.Status.Conditions[i].Type == condType {
+			return &config.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+func anonymizeReleases(releases []configv1.Release) []configv1.Release {
+	anonymized := make([]configv1.Release, len(releases))
+	for i, release := range releases {
+		release.URL = configv1.URL(anonymize.URL(string(release.URL)))
+		anonymized[i] = release
+	}
+	return anonymized
+}
+
+func anonymizeConditionalUpdates(updates []configv1.ConditionalUpdate) []configv1.ConditionalUpdate {
+	anonymized := make([]configv1.ConditionalUpdate, len(updates))
+	for i, update := range updates {
+		update.Release.URL = configv1.URL(anonymize.URL(string(update.Release.URL)))
+		anonymized[i] = update
+	}
+	return anonymized
+}
+
+// clusterVersionSignatures describes which release digests the cluster has a
+// signature for, and which keyrings vouch for each one, without leaking the
+// keyring contents themselves. VerificationBypassed records whether the
+// administrator forced past verification with `oc adm upgrade --force`,
+// which is the usual reason the digest being applied has no entry in Digests.
+type clusterVersionSignatures struct {
+	// Digests maps a release digest to the keyrings (ConfigMap references)
+	// that carry a recorded signature for it. A digest with no entries here
+	// was never signed by anything the cluster consulted.
+	Digests              map[string][]string `json:"digests"`
+	Keyrings             []string             `json:"keyrings,omitempty"`
+	VerificationBypassed bool                 `json:"verificationBypassed"`
+}
+
+// gatherClusterVersionSignatures reads the signature ConfigMaps the
+// cluster-version operator consults when verifying a release payload and
+// summarizes which release digests currently have a recorded signature. It
+// does not attempt to validate the signatures itself - that's the verifier's
+// job - only to report what data was available to it.
+func gatherClusterVersionSignatures(
+	ctx context.Context, coreClient corev1client.CoreV1Interface, config *configv1.ClusterVersion,
+) (record.Record, error) {
+	digests := map[string][]string{}
+	var keyrings []string
+
+	managed, err := coreClient.ConfigMaps(signaturesManagedNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return record.Record{}, err
+	}
+	keyrings = append(keyrings, collectSignatureDigests(managed.Items, digests, signaturesConfigMapPrefix)...)
+
+	userProvided, err := coreClient.ConfigMaps(signaturesUserNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		klog.V(2).Infof("Unable to list user-provided signature configmaps in %s: %v", signaturesUserNamespace, err)
+	} else {
+		// No naming convention to rely on here, so any ConfigMap whose data
+		// actually looks like a signature is treated as one.
+		keyrings = append(keyrings, collectSignatureDigests(userProvided.Items, digests, "")...)
+	}
+
+	if verificationConfigMap := config.Annotations[verificationConfigMapAnnotation]; verificationConfigMap != "" {
+		keyrings = append(keyrings, verificationConfigMap)
+	}
+
+	var force bool
+	if config.Spec.DesiredUpdate != nil {
+		force = config.Spec.DesiredUpdate.Force
+	}
+
+	return record.Record{
+		Name: "config/version/signatures",
+		Item: record.JSONMarshaller{Item: clusterVersionSignatures{
+			Digests:              digests,
+			Keyrings:             keyrings,
+			VerificationBypassed: force,
+		}},
+	}, nil
+}
+
+// collectSignatureDigests scans cms for ConfigMaps carrying signature data,
+// recording each release digest found against the keyring (ConfigMap
+// reference) that carries it, and returns the names of the ConfigMaps that
+// actually contained signature data. When namePrefix is non-empty, only
+// ConfigMaps named with it are considered; otherwise every ConfigMap in cms
+// is inspected and a keyring is identified by its data, not its name.
+func collectSignatureDigests(cms []corev1.ConfigMap, digests map[string][]string, namePrefix string) []string {
+	var keyrings []string
+	for i := range cms {
+		cm := &cms[i]
+		if namePrefix != "" && !strings.HasPrefix(cm.Name, namePrefix) {
+			continue
+		}
+
+		keyring := fmt.Sprintf("%s/%s", cm.Namespace, cm.Name)
+		foundSignature := false
+		for key := range cm.Data {
+			if match := signatureDataKey.FindStringSubmatch(key); match != nil {
+				digests[match[1]] = appendUniqueKeyring(digests[match[1]], keyring)
+				foundSignature = true
+			}
+		}
+		for key := range cm.BinaryData {
+			if match := signatureDataKey.FindStringSubmatch(key); match != nil {
+				digests[match[1]] = appendUniqueKeyring(digests[match[1]], keyring)
+				foundSignature = true
+			}
+		}
+
+		if foundSignature {
+			keyrings = append(keyrings, keyring)
+		}
+	}
+	return keyrings
+}
+
+func appendUniqueKeyring(keyrings []string, keyring string) []string {
+	for _, existing := range keyrings {
+		if existing == keyring {
+			return keyrings
+		}
+	}
+	return append(keyrings, keyring)
+}
@@ -0,0 +1,116 @@
+package clusterconfig
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	configv1 "github.com/openshift/api/config/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusterVersionHistory(t *testing.T) {
+	completionTime := metav1.NewTime(time.Now().Add(-time.Hour))
+	config := &configv1.ClusterVersion{
+		Status: configv1.ClusterVersionStatus{
+			History: []configv1.UpdateHistory{
+				{
+					Version:        "4.14.1",
+					Image:          "quay.io/openshift-release-dev/ocp-release@sha256:abc",
+					State:          configv1.CompletedUpdate,
+					CompletionTime: &completionTime,
+					Verified:       true,
+				},
+				{
+					Version:       "4.14.0",
+					State:         configv1.PartialUpdate,
+					Verified:      false,
+					AcceptedRisks: "accepted risk message",
+				},
+			},
+		},
+	}
+
+	history := clusterVersionHistory(config)
+
+	assert.Len(t, history, 2)
+	assert.Equal(t, "4.14.1", history[0].Version)
+	assert.True(t, history[0].Verified)
+	assert.NotNil(t, history[0].CompletionTime)
+	assert.Equal(t, configv1.PartialUpdate, history[1].State)
+	assert.Equal(t, "accepted risk message", history[1].AcceptedRisks)
+}
+
+func TestFindClusterVersionCondition(t *testing.T) {
+	config := &configv1.ClusterVersion{
+		Status: configv1.ClusterVersionStatus{
+			Conditions: []configv1.ClusterOperatorStatusCondition{
+				{Type: configv1.OperatorUpgradeable, Status: configv1.ConditionFalse, Message: "blocked"},
+				{Type: configv1.RetrievedUpdates, Status: configv1.ConditionTrue},
+			},
+		},
+	}
+
+	upgradeable := findClusterVersionCondition(config, configv1.OperatorUpgradeable)
+	if assert.NotNil(t, upgradeable) {
+		assert.Equal(t, configv1.ConditionFalse, upgradeable.Status)
+		assert.Equal(t, "blocked", upgradeable.Message)
+	}
+
+	assert.Nil(t, findClusterVersionCondition(config, configv1.OperatorDegraded))
+}
+
+func TestCollectSignatureDigests(t *testing.T) {
+	managedDigest := strings.Repeat("a", 64)
+	userDigest := strings.Repeat("b", 64)
+
+	digests := map[string][]string{}
+	managed := []corev1.ConfigMap{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: signaturesManagedNamespace, Name: "signatures-managed-1"},
+			Data: map[string]string{
+				fmt.Sprintf("sha256-%s-1", managedDigest): "signature data",
+				"not-a-signature-key":                     "ignored",
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: signaturesManagedNamespace, Name: "unrelated-configmap"},
+			Data:       map[string]string{"foo": "bar"},
+		},
+	}
+
+	keyrings := collectSignatureDigests(managed, digests, signaturesConfigMapPrefix)
+
+	assert.Equal(t, []string{signaturesManagedNamespace + "/signatures-managed-1"}, keyrings)
+	assert.Equal(t, []string{signaturesManagedNamespace + "/signatures-managed-1"}, digests["sha256-"+managedDigest])
+
+	userProvided := []corev1.ConfigMap{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: signaturesUserNamespace, Name: "my-mirror-signature"},
+			Data: map[string]string{
+				fmt.Sprintf("sha256-%s-1", userDigest): "signature data",
+			},
+		},
+	}
+
+	userKeyrings := collectSignatureDigests(userProvided, digests, "")
+
+	assert.Equal(t, []string{signaturesUserNamespace + "/my-mirror-signature"}, userKeyrings)
+	assert.Equal(t, []string{signaturesUserNamespace + "/my-mirror-signature"}, digests["sha256-"+userDigest])
+}
+
+func TestSignatureDataKey(t *testing.T) {
+	digest := strings.Repeat("c", 64)
+
+	match := signatureDataKey.FindStringSubmatch(fmt.Sprintf("sha256-%s-1", digest))
+	if assert.NotNil(t, match) {
+		assert.Equal(t, "sha256-"+digest, match[1])
+	}
+
+	assert.Nil(t, signatureDataKey.FindStringSubmatch("not-a-signature-key"))
+	assert.Nil(t, signatureDataKey.FindStringSubmatch(fmt.Sprintf("sha256-%s-1", digest[:10])))
+}